@@ -0,0 +1,100 @@
+package randomsanity
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+import netmail "net/mail"
+
+// hardBounceRE matches a permanent-failure (5.x.x) delivery status code in
+// a bounce notification body; anything else is treated as a soft bounce.
+var hardBounceRE = regexp.MustCompile(`\b5\.\d+\.\d+\b`)
+
+// bounceHandler receives the MIME bounce reports App Engine generates for
+// mail we sent, once inbound_services: mail_bounce is enabled in app.yaml.
+func bounceHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	bounce, err := mail.ParseBounce(r)
+	if err != nil {
+		errorf(logFields{RemoteIP: r.RemoteAddr, Handler: "bounceHandler"}, "mail.ParseBounce failed: %s", err)
+		http.Error(w, "bad bounce report", http.StatusBadRequest)
+		return
+	}
+	if bounce.Original == nil || len(bounce.Original.To) == 0 {
+		http.Error(w, "bounce report missing original recipient", http.StatusBadRequest)
+		return
+	}
+	address := bounce.Original.To[0]
+
+	hard := bounce.Notification != nil && hardBounceRE.MatchString(bounce.Notification.Body)
+	if err := recordBounce(ctx, address, hard, false); err != nil {
+		errorf(logFields{RemoteIP: r.RemoteAddr, Handler: "bounceHandler"}, "recordBounce failed: %s", err)
+	}
+}
+
+// mailComplaintHandler receives inbound mail routed to
+// bounces@<app-id>.appspotmail.com (an inbound mail route configured in
+// app.yaml) -- typically an ISP feedback-loop spam complaint in ARF
+// format, forwarded to us as a raw RFC 822 message.
+func mailComplaintHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	msg, err := netmail.ReadMessage(r.Body)
+	if err != nil {
+		errorf(logFields{RemoteIP: r.RemoteAddr, Handler: "mailComplaintHandler"}, "net/mail.ReadMessage failed: %s", err)
+		http.Error(w, "bad complaint report", http.StatusBadRequest)
+		return
+	}
+	address := extractOriginalRcptTo(msg)
+	if address == "" {
+		http.Error(w, "complaint report missing original recipient", http.StatusBadRequest)
+		return
+	}
+	if err := recordBounce(ctx, address, false, true); err != nil {
+		errorf(logFields{RemoteIP: r.RemoteAddr, Handler: "mailComplaintHandler"}, "recordBounce failed: %s", err)
+	}
+}
+
+// extractOriginalRcptTo pulls the address a feedback-loop report is about
+// out of its ARF body (the Original-Rcpt-To field of the embedded
+// message/feedback-report part).
+func extractOriginalRcptTo(msg *netmail.Message) string {
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(strings.ToLower(line), "original-rcpt-to:") {
+			return strings.TrimSpace(line[len("original-rcpt-to:"):])
+		}
+	}
+	return ""
+}
+
+// recordBounce updates the bounce/complaint state for every NotifyViaEmail
+// registered to address. After maxHardBounces hard bounces, or any
+// complaint, NotifyViaEmail.Blocked starts returning true: sendEmail is
+// short-circuited and future registrations of that address are rejected.
+func recordBounce(ctx appengine.Context, address string, hard bool, complaint bool) error {
+	var recipients []NotifyViaEmail
+	keys, err := datastore.NewQuery("NotifyViaEmail").Filter("Address =", address).GetAll(ctx, &recipients)
+	if err != nil {
+		return err
+	}
+	for i, n := range recipients {
+		if complaint {
+			n.Complaint = true
+		} else if hard {
+			n.HardBounces++
+		}
+		if _, err := datastore.Put(ctx, keys[i], &n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package randomsanity
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// challengeEntity is implemented by every notifier datastore kind that
+// proves ownership of its destination via a challenge/confirm round trip
+// (webhook, Slack/Discord, ntfy, Telegram) -- everything except
+// NotifyViaEmail, which verifies by the user clicking a link in email.
+// confirmChallengeHandler drives a registration to completion purely
+// through this interface, so the four register handlers only need to
+// supply the channel-specific pieces: how to extract a target, build the
+// entity, and send the challenge.
+type challengeEntity interface {
+	verified() bool
+	challengeCode() string
+	confirm()
+}
+
+// requireCurlOrWget rejects registration requests that didn't come from a
+// plain curl/wget invocation: no Origin header (blocks browser CORS
+// requests) and a curl/wget User-Agent. label is substituted into the
+// rejection message, e.g. "Slack registration must be done via curl or
+// wget". It writes the error response itself and reports whether the
+// caller should keep going.
+func requireCurlOrWget(w http.ResponseWriter, r *http.Request, label string) bool {
+	if r.Header.Get("Origin") != "" {
+		http.Error(w, "CORS requests are not allowed", http.StatusForbidden)
+		return false
+	}
+	ua := r.Header.Get("User-Agent")
+	if len(ua) < 4 || (!strings.EqualFold(ua[0:4], "curl") && !strings.EqualFold(ua[0:4], "wget")) {
+		http.Error(w, label+" registration must be done via curl or wget", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// channelRegisterLimited applies the three-tier rate limit every non-email
+// channel registration uses: 2/day per IP, 1/week per target, and 10/hour
+// globally. prefix namespaces the RateLimit keys per channel (e.g.
+// "webhookreg"). It writes the error response itself and reports whether
+// the caller was rate-limited (or RateLimitResponse itself failed).
+func channelRegisterLimited(ctx appengine.Context, w http.ResponseWriter, r *http.Request, prefix string, target string) bool {
+	limited, err := RateLimitResponse(ctx, w, IPKey(prefix, r.RemoteAddr), 2, time.Hour*24)
+	if err != nil || limited {
+		return true
+	}
+	limited, err = RateLimitResponse(ctx, w, prefix+target, 1, time.Hour*24*7)
+	if err != nil || limited {
+		return true
+	}
+	limited, err = RateLimitResponse(ctx, w, prefix, 10, time.Hour)
+	if err != nil || limited {
+		return true
+	}
+	return false
+}
+
+// challengeConfirmLimited rate-limits confirm attempts per id and per IP.
+// Slack/ntfy/telegram challenges are only 4 random bytes, so without this
+// the confirm endpoint would be a free brute-force oracle for "confirming"
+// a channel/topic/chat an attacker doesn't actually control.
+func challengeConfirmLimited(ctx appengine.Context, w http.ResponseWriter, r *http.Request, id string) bool {
+	limited, err := RateLimitResponse(ctx, w, IPKey("challengeconfirm", r.RemoteAddr), 20, time.Hour)
+	if err != nil || limited {
+		return true
+	}
+	limited, err = RateLimitResponse(ctx, w, "challengeconfirm"+id, 20, time.Hour)
+	if err != nil || limited {
+		return true
+	}
+	return false
+}
+
+// randHex returns n random bytes hex-encoded. Used for generating
+// registration ids, webhook secrets, and challenge codes.
+func randHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// confirmChallengeHandler implements the shared second half of the
+// register/confirm round trip for every challengeEntity kind: parse
+// id/challenge out of the URL, load the entity, compare the challenge, and
+// mark it verified. new must return a pointer to a freshly zeroed entity
+// of the right concrete type; describe formats the id into the
+// already-verified/now-verified response messages (e.g. "webhook "+id).
+func confirmChallengeHandler(w http.ResponseWriter, r *http.Request, kind string, new func() challengeEntity, describe func(id string) string) {
+	if r.Method != "POST" {
+		http.Error(w, "confirm method must be POST", http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 6 {
+		http.Error(w, "Missing id/challenge", http.StatusBadRequest)
+		return
+	}
+	id, challenge := parts[4], parts[5]
+
+	ctx := appengine.NewContext(r)
+	if challengeConfirmLimited(ctx, w, r, id) {
+		return
+	}
+	dbKey, err := notifyKey(ctx, kind, id)
+	if err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+	if dbKey == nil {
+		http.Error(w, "User ID not found", http.StatusNotFound)
+		return
+	}
+	n := new()
+	if err := datastore.Get(ctx, dbKey, n); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+	if n.verified() {
+		fmt.Fprintf(w, "%s already verified\n", describe(id))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(n.challengeCode()), []byte(challenge)) != 1 {
+		http.Error(w, "Challenge mismatch", http.StatusForbidden)
+		return
+	}
+	n.confirm()
+	if _, err := datastore.Put(ctx, dbKey, n); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%s verified\n", describe(id))
+}
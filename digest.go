@@ -0,0 +1,149 @@
+package randomsanity
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// isTrustedCron reports whether r looks like a genuine App Engine cron
+// invocation rather than an arbitrary POST from the internet. Otherwise an
+// attacker could hit /cron/digest/<mode> right after every RNG failure and
+// turn digest mode back into near-real-time per-failure mail. App Engine
+// strips any caller-supplied X-Appengine-Cron header and only sets it
+// itself for requests it dispatches from cron.yaml; we also require a
+// shared secret as defense in depth, the same pattern loglevelHandler uses.
+func isTrustedCron(r *http.Request) bool {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		return false
+	}
+	secret := os.Getenv("RANDOMSANITY_CRON_SECRET")
+	return secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Cron-Secret")), []byte(secret)) == 1
+}
+
+// flushDigestsHandler is hit by App Engine cron (an hourly entry pointing
+// at /cron/digest/hourly and a daily entry pointing at /cron/digest/daily)
+// to roll every PendingFailure queued by users on that Mode into a single
+// summary email, instead of one email per failure.
+func flushDigestsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isTrustedCron(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 {
+		http.Error(w, "Usage: /cron/digest/<mode>", http.StatusBadRequest)
+		return
+	}
+	mode := parts[3]
+	if mode != DigestHourly && mode != DigestDaily {
+		http.Error(w, "mode must be hourly or daily", http.StatusBadRequest)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	var recipients []NotifyViaEmail
+	if _, err := datastore.NewQuery("NotifyViaEmail").Filter("Mode =", mode).GetAll(ctx, &recipients); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+	for _, n := range recipients {
+		flushPendingFailures(ctx, n)
+	}
+	fmt.Fprintf(w, "flushed %d digest recipients\n", len(recipients))
+}
+
+func flushPendingFailures(ctx appengine.Context, n NotifyViaEmail) {
+	var pending []PendingFailure
+	keys, err := datastore.NewQuery("PendingFailure").Filter("UserID =", n.UserID).GetAll(ctx, &pending)
+	if err != nil {
+		errorf(logFields{UserID: n.UserID, Handler: "flushPendingFailures"}, "Datastore error: %s", err)
+		return
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if n.Blocked() {
+		// This address bounced or complained after these failures were
+		// queued: drop them instead of mailing them out at the next flush.
+		if err := datastore.DeleteMulti(ctx, keys); err != nil {
+			errorf(logFields{UserID: n.UserID, Handler: "flushPendingFailures"}, "Datastore error: %s", err)
+		}
+		return
+	}
+	if err := sendDigestEmail(ctx, n.Address, pending); err != nil {
+		warnf(logFields{UserID: n.UserID, Handler: "flushPendingFailures"}, "mail.Send failed: %s", err)
+		return
+	}
+	if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		errorf(logFields{UserID: n.UserID, Handler: "flushPendingFailures"}, "Datastore error: %s", err)
+	}
+}
+
+func sendDigestEmail(ctx appengine.Context, address string, pending []PendingFailure) error {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "The randomsanity.org service has detected %d failures:\n\n", len(pending))
+	for _, pf := range pending {
+		fmt.Fprintf(&body, "- [%s] tag=%s reason=%s data=0x%s\n",
+			pf.Timestamp.Format("2006-01-02T15:04:05Z07:00"), pf.Tag, pf.Reason, pf.DataHex)
+	}
+	msg := &mail.Message{
+		Sender:  "randomsanityalerts@gmail.com",
+		To:      []string{address},
+		Subject: fmt.Sprintf("Random Sanity: %d failures detected", len(pending)),
+		Body:    body.String(),
+	}
+	return mail.Send(ctx, msg)
+}
+
+// setModeHandler lets a registered user switch between immediate, hourly
+// and daily digest delivery after the fact.
+func setModeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "setmode method must be POST", http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 {
+		http.Error(w, "Usage: /setmode/<id>/<mode>", http.StatusBadRequest)
+		return
+	}
+	id, mode := parts[2], parts[3]
+	if !validDigestMode(mode) {
+		http.Error(w, "mode must be one of immediate, hourly, daily", http.StatusBadRequest)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	dbKey, err := userID(ctx, id)
+	if err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+	if dbKey == nil {
+		http.Error(w, "User ID not found", http.StatusNotFound)
+		return
+	}
+	var n NotifyViaEmail
+	if err := datastore.Get(ctx, dbKey, &n); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+	n.Mode = mode
+	if _, err := datastore.Put(ctx, dbKey, &n); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+	// Anything already queued under the old mode is flushed right away.
+	// After a switch to immediate it would otherwise never be picked up
+	// again, since flushDigestsHandler only ever queries NotifyViaEmail by
+	// its current Mode.
+	flushPendingFailures(ctx, n)
+	fmt.Fprintf(w, "mode set to %s for id %s\n", mode, id)
+}
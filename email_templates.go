@@ -0,0 +1,100 @@
+package randomsanity
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"path/filepath"
+	texttemplate "text/template"
+)
+
+// defaultLang is used whenever a user has no Lang recorded, or their Lang
+// hasn't been translated under email_templates/ yet.
+const defaultLang = "en"
+
+// supportedLangs is the allowlist of languages with a translation under
+// email_templates/. langFromAcceptLanguage and renderEmail both check
+// against it rather than trusting their input directly: Accept-Language is
+// attacker-controlled, and Lang ends up in a filepath.Join, so anything not
+// on this list must be rejected instead of reaching the filesystem.
+var supportedLangs = map[string]bool{
+	"en": true,
+	"es": true,
+}
+
+// langFromAcceptLanguage picks the primary language subtag out of an
+// Accept-Language header value, e.g. "es-ES,es;q=0.9,en;q=0.8" -> "es".
+func langFromAcceptLanguage(header string) string {
+	if header == "" {
+		return defaultLang
+	}
+	tag := header
+	if i := indexAny(tag, ",;"); i >= 0 {
+		tag = tag[:i]
+	}
+	if i := indexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	if !supportedLangs[tag] {
+		return defaultLang
+	}
+	return tag
+}
+
+func indexAny(s string, chars string) int {
+	for i := 0; i < len(s); i++ {
+		for j := 0; j < len(chars); j++ {
+			if s[i] == chars[j] {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// renderEmail renders email_templates/<lang>/<name>.txt and .html with
+// data, falling back to defaultLang if lang has no translation yet.
+func renderEmail(lang string, name string, data interface{}) (text string, html string, err error) {
+	if !supportedLangs[lang] {
+		lang = defaultLang
+	}
+	textPath := filepath.Join("email_templates", lang, name+".txt")
+	htmlPath := filepath.Join("email_templates", lang, name+".html")
+
+	tt, err := texttemplate.ParseFiles(textPath)
+	if err != nil {
+		if lang != defaultLang {
+			return renderEmail(defaultLang, name, data)
+		}
+		return "", "", err
+	}
+	var textBuf bytes.Buffer
+	if err := tt.Execute(&textBuf, data); err != nil {
+		return "", "", err
+	}
+
+	ht, err := htmltemplate.ParseFiles(htmlPath)
+	if err != nil {
+		if lang != defaultLang {
+			return renderEmail(defaultLang, name, data)
+		}
+		return "", "", err
+	}
+	var htmlBuf bytes.Buffer
+	if err := ht.Execute(&htmlBuf, data); err != nil {
+		return "", "", err
+	}
+
+	return textBuf.String(), htmlBuf.String(), nil
+}
+
+type confirmTemplateData struct {
+	Address string
+	ID      string
+}
+
+type alertTemplateData struct {
+	Reason         string
+	DataHex        string
+	Tag            string
+	UnsubscribeURL string
+}
@@ -0,0 +1,141 @@
+package randomsanity
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel orders the verbosity of structured log entries; a call only
+// emits if its level is at or above the currently active level.
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func parseLogLevel(s string) (LogLevel, bool) {
+	switch strings.ToUpper(s) {
+	case "DEBUG":
+		return LevelDebug, true
+	case "INFO":
+		return LevelInfo, true
+	case "WARN", "WARNING":
+		return LevelWarn, true
+	case "ERROR":
+		return LevelError, true
+	}
+	return LevelInfo, false
+}
+
+// activeLogLevel is read/written atomically so loglevelHandler can change
+// verbosity at runtime without a redeploy.
+var activeLogLevel int32 = int32(LevelInfo)
+
+func currentLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&activeLogLevel))
+}
+
+func setLogLevel(l LogLevel) {
+	atomic.StoreInt32(&activeLogLevel, int32(l))
+}
+
+// logFields is the per-request context threaded through a structured log
+// call. UserID is hashed before it's written so logs never contain a raw
+// notification id.
+type logFields struct {
+	RemoteIP string
+	UserID   string
+	Handler  string
+}
+
+type logEntry struct {
+	Level    string `json:"level"`
+	Message  string `json:"message"`
+	RemoteIP string `json:"remote_ip,omitempty"`
+	UserHash string `json:"user_hash,omitempty"`
+	Handler  string `json:"handler,omitempty"`
+}
+
+func hashUserID(id string) string {
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func logf(level LogLevel, f logFields, format string, args ...interface{}) {
+	if level < currentLogLevel() {
+		return
+	}
+	b, err := json.Marshal(logEntry{
+		Level:    level.String(),
+		Message:  fmt.Sprintf(format, args...),
+		RemoteIP: f.RemoteIP,
+		UserHash: hashUserID(f.UserID),
+		Handler:  f.Handler,
+	})
+	if err != nil {
+		log.Printf("logf: json.Marshal failed: %s", err)
+		return
+	}
+	log.Println(string(b))
+}
+
+func debugf(f logFields, format string, args ...interface{}) { logf(LevelDebug, f, format, args...) }
+func infof(f logFields, format string, args ...interface{})  { logf(LevelInfo, f, format, args...) }
+func warnf(f logFields, format string, args ...interface{})  { logf(LevelWarn, f, format, args...) }
+func errorf(f logFields, format string, args ...interface{}) { logf(LevelError, f, format, args...) }
+
+// loglevelHandler lets operators swap the active log level at runtime, e.g.
+// to turn on DEBUG tracing of RNG-failure notifications while investigating
+// an incident and turn it back off, without a redeploy. Protected by a
+// shared secret rather than auth since it's meant to be hit by ops tooling.
+func loglevelHandler(w http.ResponseWriter, r *http.Request) {
+	secret := os.Getenv("RANDOMSANITY_ADMIN_SECRET")
+	if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Secret")), []byte(secret)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == "GET" {
+		fmt.Fprintf(w, "%s\n", currentLogLevel())
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "loglevel method must be GET or POST", http.StatusBadRequest)
+		return
+	}
+	level, ok := parseLogLevel(r.FormValue("level"))
+	if !ok {
+		http.Error(w, "level must be one of DEBUG, INFO, WARN, ERROR", http.StatusBadRequest)
+		return
+	}
+	setLogLevel(level)
+	fmt.Fprintf(w, "log level set to %s\n", level)
+}
@@ -4,11 +4,14 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"appengine/mail"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 )
@@ -20,16 +23,87 @@ import netmail "net/mail"
 type NotifyViaEmail struct {
 	UserID  string
 	Address string
+	// Mode controls how failures are delivered: immediately, or batched
+	// into a periodic digest. See DigestImmediate et al below.
+	Mode string
+	// Lang selects which email_templates/<Lang>/ directory to render
+	// alerts and confirmations from, e.g. "en" or "es".
+	Lang string
+	// Source records how this registration was verified: the CLI path
+	// (SourceCLI) or the web fallback (SourceWebCaptcha/SourceWebOAuth).
+	Source string
+	// HardBounces counts permanent delivery failures reported by
+	// bounceHandler; Complaint is set by mailComplaintHandler the first
+	// time this address files a spam complaint. See Blocked.
+	HardBounces int
+	Complaint   bool
 }
 
-// Return userID associated with request (or empty string)
-func userID(ctx appengine.Context, id string) (*datastore.Key, error) {
-	// Only pay attention to ?id=123456 if they've done an authentication loop
-	// and are already in the database
+// maxHardBounces is how many permanent delivery failures an address is
+// allowed before we stop mailing it.
+const maxHardBounces = 3
+
+// Blocked reports whether this address has bounced or complained enough
+// that we should stop sending it mail.
+func (d NotifyViaEmail) Blocked() bool {
+	return d.Complaint || d.HardBounces >= maxHardBounces
+}
+
+// Registration sources for NotifyViaEmail.Source.
+const (
+	SourceCLI        = "cli"
+	SourceWebCaptcha = "web-captcha"
+	SourceWebOAuth   = "web-oauth"
+)
+
+// Digest delivery modes for NotifyViaEmail.Mode.
+const (
+	DigestImmediate = "immediate"
+	DigestHourly    = "hourly"
+	DigestDaily     = "daily"
+)
+
+func validDigestMode(mode string) bool {
+	switch mode {
+	case DigestImmediate, DigestHourly, DigestDaily:
+		return true
+	}
+	return false
+}
+
+// PendingFailure queues one failure for a user on a digest Mode, until the
+// cron-triggered flushDigestsHandler rolls them into a single summary email.
+type PendingFailure struct {
+	UserID    string
+	Tag       string
+	DataHex   string
+	Reason    string
+	Timestamp time.Time
+}
+
+// NotifyPayload carries the details of a detected failure to every
+// notification channel a user has registered.
+type NotifyPayload struct {
+	Tag       string
+	DataHex   string
+	Reason    string
+	Timestamp time.Time
+}
+
+// Notifier is implemented by each notification channel kind (email,
+// webhook, Slack, ntfy, Telegram, ...). Send delivers p to whatever
+// destination the receiver was registered with.
+type Notifier interface {
+	Send(ctx appengine.Context, p NotifyPayload) error
+}
+
+// notifyKey looks up the datastore key of the given kind for a UserID,
+// or nil if there's no such registration.
+func notifyKey(ctx appengine.Context, kind string, id string) (*datastore.Key, error) {
 	if len(id) == 0 {
 		return nil, nil
 	}
-	q := datastore.NewQuery("NotifyViaEmail").Filter("UserID =", id).Limit(1).KeysOnly()
+	q := datastore.NewQuery(kind).Filter("UserID =", id).Limit(1).KeysOnly()
 	keys, err := q.GetAll(ctx, nil)
 	if err != nil || len(keys) == 0 {
 		return nil, err
@@ -37,6 +111,13 @@ func userID(ctx appengine.Context, id string) (*datastore.Key, error) {
 	return keys[0], nil
 }
 
+// Return the NotifyViaEmail datastore key registered for id (or nil)
+func userID(ctx appengine.Context, id string) (*datastore.Key, error) {
+	// Only pay attention to ?id=123456 if they've done an authentication loop
+	// and are already in the database
+	return notifyKey(ctx, "NotifyViaEmail", id)
+}
+
 // Register an email address. To authenticate ownership of the
 // address, the server assigns a random user id and emails it.
 // To mitigate abuse, this method is heavily rate-limited per
@@ -71,6 +152,16 @@ func registerEmailHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	address := addresses[0]
 
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = DigestImmediate
+	}
+	if !validDigestMode(mode) {
+		http.Error(w, "mode must be one of immediate, hourly, daily", http.StatusBadRequest)
+		return
+	}
+	lang := langFromAcceptLanguage(r.Header.Get("Accept-Language"))
+
 	ctx := appengine.NewContext(r)
 
 	// 2 registrations per IP per day
@@ -101,7 +192,11 @@ func registerEmailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if len(notify) > 0 {
-		sendNewID(ctx, address.Address, notify[0].UserID)
+		if notify[0].Blocked() {
+			http.Error(w, "This address has bounced or complained and can no longer be registered", http.StatusForbidden)
+			return
+		}
+		sendNewID(ctx, address.Address, notify[0].UserID, notify[0].Lang)
 		fmt.Fprintf(w, "Check your email, ID sent to %s\n", address.Address)
 		return
 	}
@@ -111,21 +206,33 @@ func registerEmailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	id := hex.EncodeToString(bytes)
-	n := NotifyViaEmail{id, address.Address}
+	n := NotifyViaEmail{UserID: id, Address: address.Address, Mode: mode, Lang: lang, Source: SourceCLI}
 	k := datastore.NewIncompleteKey(ctx, "NotifyViaEmail", nil)
 	if _, err := datastore.Put(ctx, k, &n); err != nil {
 		http.Error(w, "Datastore error", http.StatusInternalServerError)
 		return
 	}
-	sendNewID(ctx, address.Address, id)
+	sendNewID(ctx, address.Address, id, lang)
 	// HTTP response MUST NOT contain the id
 	fmt.Fprintf(w, "Check your email, ID sent to %s", address.Address)
 }
 
-// Unregister, given userID
+// Unregister, given userID. The CLI path authenticates by requiring
+// DELETE; the one-click link in alert emails instead authenticates with a
+// signed token (see signUnsubscribeToken), per RFC 8058.
 func unRegisterIDHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "DELETE" {
-		http.Error(w, "unregister method must be DELETE", http.StatusBadRequest)
+	uIDForToken := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	token := r.URL.Query().Get("token")
+	switch {
+	case r.Method == "DELETE":
+		// CLI path: no token required.
+	case r.Method == "POST" && token != "":
+		if !validUnsubscribeToken(uIDForToken, token) {
+			http.Error(w, "Invalid unsubscribe token", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "unregister method must be DELETE, or POST with a valid token", http.StatusBadRequest)
 		return
 	}
 	parts := strings.Split(r.URL.Path, "/")
@@ -157,54 +264,101 @@ func unRegisterIDHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "id %s unregistered\n", uID)
 }
 
-func sendNewID(ctx appengine.Context, address string, id string) {
+func sendNewID(ctx appengine.Context, address string, id string, lang string) {
 	msg := &mail.Message{
 		Sender:  "randomsanityalerts@gmail.com",
 		To:      []string{address},
 		Subject: "Random Sanity id request",
 	}
-	msg.Body = fmt.Sprintf("Somebody requested an id for this email address (%s)\n"+
-		"for the randomsanity.org service.\n"+
-		"\n"+
-		"id: %s\n"+
-		"\n"+
-		"Append ?id=%s to API calls to be notified of failures via email.\n"+
-		"\n"+
-		"If somebody is pretending to be you and you don't use the randomsanity.org\n"+
-		"service, please ignore this message.\n",
-		address, id, id)
+	text, html, err := renderEmail(lang, "confirm", confirmTemplateData{Address: address, ID: id})
+	if err != nil {
+		errorf(logFields{UserID: id, Handler: "sendNewID"}, "renderEmail failed: %s", err)
+		return
+	}
+	msg.Body = text
+	msg.HTMLBody = html
 	if err := mail.Send(ctx, msg); err != nil {
-		log.Printf("mail.Send failed: %s", err)
+		errorf(logFields{UserID: id, Handler: "sendNewID"}, "mail.Send failed: %s", err)
 	}
 }
 
-func sendEmail(ctx appengine.Context, address string, tag string, b []byte, reason string) {
+func sendEmail(ctx appengine.Context, uid string, address string, tag string, dataHex string, reason string, lang string) error {
 	// Don't spam if there are hundreds of failures, limit to
 	// a handful per day:
 	limit, err := RateLimit(ctx, address, 5, time.Hour*24)
 	if err != nil || limit {
-		return
+		return err
 	}
 
-	msg := &mail.Message{
-		Sender:  "randomsanityalerts@gmail.com",
-		To:      []string{address},
-		Subject: "Random Number Generator Failure Detected",
+	unsubURL := unsubscribeURL(uid)
+	text, html, err := renderEmail(lang, "alert", alertTemplateData{
+		Reason:         reason,
+		DataHex:        dataHex,
+		Tag:            tag,
+		UnsubscribeURL: unsubURL,
+	})
+	if err != nil {
+		return err
 	}
-	msg.Body = fmt.Sprintf("The randomsanity.org service has detected a failure.\n"+
-		"\n"+
-		"Failure reason: %s\n"+
-		"Data: 0x%s\n"+
-		"Tag: %s\n", reason, hex.EncodeToString(b), tag)
-	if err := mail.Send(ctx, msg); err != nil {
-		log.Printf("mail.Send failed: %s", err)
+
+	msg := &mail.Message{
+		Sender:   "randomsanityalerts@gmail.com",
+		To:       []string{address},
+		Subject:  "Random Number Generator Failure Detected",
+		Body:     text,
+		HTMLBody: html,
+		Headers: mail.Header{
+			// RFC 8058 one-click unsubscribe: mail clients can POST back
+			// to unsubURL without the user ever opening the message.
+			"List-Unsubscribe":      {fmt.Sprintf("<%s>", unsubURL)},
+			"List-Unsubscribe-Post": {"List-Unsubscribe=One-Click"},
+		},
 	}
+	return mail.Send(ctx, msg)
 }
 
-func notify(ctx appengine.Context, uid string, tag string, b []byte, reason string) {
-	if len(uid) == 0 {
-		return
+// unsubscribeURL builds the signed, no-auth-required one-click unsubscribe
+// link used both in the List-Unsubscribe header above and as a fallback
+// link in the email body for clients that don't support the header.
+func unsubscribeURL(uid string) string {
+	return fmt.Sprintf("https://randomsanity.org/unregister/%s?token=%s", uid, signUnsubscribeToken(uid))
+}
+
+func unsubscribeSecret() []byte {
+	return []byte(os.Getenv("RANDOMSANITY_UNSUB_SECRET"))
+}
+
+func signUnsubscribeToken(uid string) string {
+	mac := hmac.New(sha256.New, unsubscribeSecret())
+	mac.Write([]byte(uid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validUnsubscribeToken(uid string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(signUnsubscribeToken(uid)), []byte(token)) == 1
+}
+
+// Send implements Notifier for the email channel. Users on a digest Mode
+// have their failures queued instead of mailed immediately; see
+// flushDigestsHandler for how those get delivered.
+func (d NotifyViaEmail) Send(ctx appengine.Context, p NotifyPayload) error {
+	if d.Blocked() {
+		return nil
+	}
+	if d.Mode == DigestHourly || d.Mode == DigestDaily {
+		return queuePendingFailure(ctx, d.UserID, p)
 	}
+	return sendEmail(ctx, d.UserID, d.Address, p.Tag, p.DataHex, p.Reason, d.Lang)
+}
+
+func queuePendingFailure(ctx appengine.Context, uid string, p NotifyPayload) error {
+	pf := PendingFailure{uid, p.Tag, p.DataHex, p.Reason, p.Timestamp}
+	k := datastore.NewIncompleteKey(ctx, "PendingFailure", nil)
+	_, err := datastore.Put(ctx, k, &pf)
+	return err
+}
+
+func notifyEmail(ctx appengine.Context, uid string, p NotifyPayload) {
 	q := datastore.NewQuery("NotifyViaEmail").Filter("UserID =", uid)
 	for t := q.Run(ctx); ; {
 		var d NotifyViaEmail
@@ -213,9 +367,31 @@ func notify(ctx appengine.Context, uid string, tag string, b []byte, reason stri
 			break
 		}
 		if err != nil {
-			log.Printf("Datastore error: %s", err.Error())
+			errorf(logFields{UserID: uid, Handler: "notifyEmail"}, "Datastore error: %s", err)
 			return
 		}
-		sendEmail(ctx, d.Address, tag, b, reason)
+		if err := d.Send(ctx, p); err != nil {
+			warnf(logFields{UserID: uid, Handler: "notifyEmail"}, "mail.Send failed: %s", err)
+		}
 	}
-}
\ No newline at end of file
+}
+
+// notify fans the failure out to every channel (email, webhook, Slack,
+// ntfy, Telegram, ...) the user identified by uid has registered.
+func notify(ctx appengine.Context, uid string, tag string, b []byte, reason string) {
+	if len(uid) == 0 {
+		return
+	}
+	p := NotifyPayload{
+		Tag:       tag,
+		DataHex:   hex.EncodeToString(b),
+		Reason:    reason,
+		Timestamp: time.Now(),
+	}
+
+	notifyEmail(ctx, uid, p)
+	notifyWebhooks(ctx, uid, p)
+	notifySlack(ctx, uid, p)
+	notifyNtfy(ctx, uid, p)
+	notifyTelegram(ctx, uid, p)
+}
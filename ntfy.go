@@ -0,0 +1,136 @@
+package randomsanity
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// NotifyViaNtfy pushes alerts to a ntfy.sh (or self-hosted ntfy) topic.
+type NotifyViaNtfy struct {
+	UserID    string
+	Topic     string
+	Server    string // defaults to https://ntfy.sh if empty
+	Verified  bool
+	Challenge string
+}
+
+func (d NotifyViaNtfy) server() string {
+	if d.Server == "" {
+		return "https://ntfy.sh"
+	}
+	return d.Server
+}
+
+func (d *NotifyViaNtfy) verified() bool        { return d.Verified }
+func (d *NotifyViaNtfy) challengeCode() string { return d.Challenge }
+func (d *NotifyViaNtfy) confirm()              { d.Verified = true; d.Challenge = "" }
+
+// Send implements Notifier for the ntfy channel.
+func (d NotifyViaNtfy) Send(ctx appengine.Context, p NotifyPayload) error {
+	if !d.Verified {
+		return nil
+	}
+	msg := fmt.Sprintf("Reason: %s\nTag: %s\nData: 0x%s", p.Reason, p.Tag, p.DataHex)
+	return postNtfyMessage(ctx, d.server(), d.Topic, "Random Number Generator Failure Detected", msg)
+}
+
+func notifyNtfy(ctx appengine.Context, uid string, p NotifyPayload) {
+	q := datastore.NewQuery("NotifyViaNtfy").Filter("UserID =", uid)
+	for t := q.Run(ctx); ; {
+		var d NotifyViaNtfy
+		_, err := t.Next(&d)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			errorf(logFields{UserID: uid, Handler: "notifyNtfy"}, "Datastore error: %s", err)
+			return
+		}
+		if err := d.Send(ctx, p); err != nil {
+			warnf(logFields{UserID: uid, Handler: "notifyNtfy"}, "ntfy POST failed: %s", err)
+		}
+	}
+}
+
+func postNtfyMessage(ctx appengine.Context, server string, topic string, title string, body string) error {
+	req, err := http.NewRequest("POST", server+"/"+topic, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", title)
+	resp, err := urlfetch.Client(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("ntfy POST to %s/%s returned %s", server, topic, resp.Status)
+	}
+	return nil
+}
+
+// Register an ntfy.sh topic. To mitigate abuse, this method is
+// rate-limited the same way registerEmailHandler is.
+func registerNtfyHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireCurlOrWget(w, r, "ntfy") {
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || len(parts[len(parts)-1]) == 0 {
+		http.Error(w, "Missing topic", http.StatusBadRequest)
+		return
+	}
+	if len(parts) > 4 {
+		http.Error(w, "URL path too long", http.StatusBadRequest)
+		return
+	}
+	topic := parts[len(parts)-1]
+
+	ctx := appengine.NewContext(r)
+
+	if channelRegisterLimited(ctx, w, r, "ntfyreg", topic) {
+		return
+	}
+
+	id, err := randHex(8)
+	if err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+	challenge, err := randHex(4)
+	if err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+
+	n := NotifyViaNtfy{id, topic, "", false, challenge}
+	k := datastore.NewIncompleteKey(ctx, "NotifyViaNtfy", nil)
+	if _, err := datastore.Put(ctx, k, &n); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	// ntfy topics are just names anyone can guess, so prove the caller is
+	// actually subscribed: push a confirmation code and require it to be
+	// relayed back to the confirm endpoint.
+	msg := fmt.Sprintf("Your randomsanity.org confirmation code is %s\nPOST it to /register/ntfy/confirm/%s/%s to finish registering.", challenge, id, challenge)
+	if err := postNtfyMessage(ctx, n.server(), topic, "randomsanity.org confirmation code", msg); err != nil {
+		warnf(logFields{RemoteIP: r.RemoteAddr, UserID: id, Handler: "registerNtfyHandler"}, "ntfy challenge POST failed: %s", err)
+	}
+
+	fmt.Fprintf(w, "Confirmation code pushed to topic %s, POST it to /register/ntfy/confirm/%s/<code> to finish registering\n", topic, id)
+}
+
+// confirmNtfyHandler completes registration once the confirmation code
+// pushed to the topic is relayed back to us.
+func confirmNtfyHandler(w http.ResponseWriter, r *http.Request) {
+	confirmChallengeHandler(w, r, "NotifyViaNtfy",
+		func() challengeEntity { return &NotifyViaNtfy{} },
+		func(id string) string { return "ntfy topic " + id })
+}
@@ -0,0 +1,210 @@
+package randomsanity
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+	"appengine/user"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+import netmail "net/mail"
+
+const csrfCookieName = "randomsanity_csrf"
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+var registerPageTemplate = template.Must(template.New("register").Parse(`<!DOCTYPE html>
+<html>
+<body>
+  <h1>Register for randomsanity.org alerts</h1>
+  {{if .SignedIn}}
+  <form method="POST" action="/register">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <input type="hidden" name="source" value="web-oauth">
+    <p>Signed in as {{.UserEmail}}.</p>
+    <input type="email" name="email" placeholder="you@example.com" required>
+    <button type="submit">Register</button>
+  </form>
+  {{else}}
+  <p><a href="{{.LoginURL}}">Sign in with Google</a> to register without solving a CAPTCHA.</p>
+  <form method="POST" action="/register">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <input type="hidden" name="source" value="web-captcha">
+    <input type="email" name="email" placeholder="you@example.com" required>
+    <div class="h-captcha" data-sitekey="{{.SiteKey}}"></div>
+    <script src="https://hcaptcha.com/1/api.js" async defer></script>
+    <button type="submit">Register</button>
+  </form>
+  {{end}}
+</body>
+</html>
+`))
+
+type registerPageData struct {
+	CSRFToken string
+	SiteKey   string
+	LoginURL  string
+	SignedIn  bool
+	UserEmail string
+}
+
+// registerPageHandler serves the HTML fallback registration form at
+// /register. Unlike registerEmailHandler, this path is reachable from a
+// browser: abuse is mitigated by requiring a solved CAPTCHA or a completed
+// Google sign-in, instead of the curl/wget restriction.
+func registerPageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: csrfCookieName, Value: csrfToken, Path: "/register", HttpOnly: true, Secure: true})
+
+	loginURL, err := user.LoginURL(ctx, "/register")
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	data := registerPageData{
+		CSRFToken: csrfToken,
+		SiteKey:   os.Getenv("RANDOMSANITY_HCAPTCHA_SITEKEY"),
+		LoginURL:  loginURL,
+	}
+	if u := user.Current(ctx); u != nil {
+		data.SignedIn = true
+		data.UserEmail = u.Email
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := registerPageTemplate.Execute(w, data); err != nil {
+		errorf(logFields{RemoteIP: r.RemoteAddr, Handler: "registerPageHandler"}, "template.Execute failed: %s", err)
+	}
+}
+
+// registerWebHandler handles the POST from the form served above. Verified
+// web registrations carry Source web-captcha or web-oauth and are subject
+// to their own (looser) rate limits, since the CAPTCHA/OAuth check is
+// itself an anti-abuse gate in addition to them.
+func registerWebHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "register method must be POST", http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.FormValue("csrf_token"))) != 1 {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+
+	addresses, err := netmail.ParseAddressList(r.FormValue("email"))
+	if err != nil || len(addresses) != 1 {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	address := addresses[0]
+
+	source := r.FormValue("source")
+	switch source {
+	case SourceWebOAuth:
+		if user.Current(ctx) == nil {
+			http.Error(w, "Google sign-in required", http.StatusForbidden)
+			return
+		}
+	case SourceWebCaptcha:
+		ok, err := verifyCaptcha(ctx, r.FormValue("h-captcha-response"), r.RemoteAddr)
+		if err != nil || !ok {
+			http.Error(w, "CAPTCHA verification failed", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "Invalid source", http.StatusBadRequest)
+		return
+	}
+
+	// Independent, looser limits than the CLI path in registerEmailHandler.
+	limited, err := RateLimitResponse(ctx, w, IPKey("webreg", r.RemoteAddr), 10, time.Hour*24)
+	if err != nil || limited {
+		return
+	}
+	limited, err = RateLimitResponse(ctx, w, "webreg"+address.Address, 1, time.Hour*24*7)
+	if err != nil || limited {
+		return
+	}
+
+	var notify []NotifyViaEmail
+	q := datastore.NewQuery("NotifyViaEmail").Filter("Address =", address.Address)
+	if _, err := q.GetAll(ctx, &notify); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+	if len(notify) > 0 {
+		if notify[0].Blocked() {
+			http.Error(w, "This address has bounced or complained and can no longer be registered", http.StatusForbidden)
+			return
+		}
+		sendNewID(ctx, address.Address, notify[0].UserID, notify[0].Lang)
+		fmt.Fprintf(w, "Check your email, ID sent to %s\n", address.Address)
+		return
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idBytes)
+	lang := langFromAcceptLanguage(r.Header.Get("Accept-Language"))
+	n := NotifyViaEmail{UserID: id, Address: address.Address, Mode: DigestImmediate, Lang: lang, Source: source}
+	k := datastore.NewIncompleteKey(ctx, "NotifyViaEmail", nil)
+	if _, err := datastore.Put(ctx, k, &n); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+	sendNewID(ctx, address.Address, id, lang)
+	// HTTP response MUST NOT contain the id
+	fmt.Fprintf(w, "Check your email, ID sent to %s", address.Address)
+}
+
+func verifyCaptcha(ctx appengine.Context, response string, remoteAddr string) (bool, error) {
+	secret := os.Getenv("RANDOMSANITY_HCAPTCHA_SECRET")
+	if secret == "" || response == "" {
+		return false, nil
+	}
+	resp, err := urlfetch.Client(ctx).PostForm("https://hcaptcha.com/siteverify", url.Values{
+		"secret":   {secret},
+		"response": {response},
+		"remoteip": {remoteAddr},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
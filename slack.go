@@ -0,0 +1,134 @@
+package randomsanity
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// NotifyViaSlack posts alerts to a Slack or Discord incoming webhook URL.
+// Both accept the same {"text": "..."} JSON body, so one implementation
+// covers either.
+type NotifyViaSlack struct {
+	UserID    string
+	URL       string
+	Verified  bool
+	Challenge string
+}
+
+func (d *NotifyViaSlack) verified() bool        { return d.Verified }
+func (d *NotifyViaSlack) challengeCode() string { return d.Challenge }
+func (d *NotifyViaSlack) confirm()              { d.Verified = true; d.Challenge = "" }
+
+// Send implements Notifier for the Slack/Discord channel.
+func (d NotifyViaSlack) Send(ctx appengine.Context, p NotifyPayload) error {
+	if !d.Verified {
+		return nil
+	}
+	text := fmt.Sprintf("*Random Number Generator Failure Detected*\nReason: %s\nTag: %s\nData: 0x%s",
+		p.Reason, p.Tag, p.DataHex)
+	return postSlackMessage(ctx, d.URL, text)
+}
+
+func notifySlack(ctx appengine.Context, uid string, p NotifyPayload) {
+	q := datastore.NewQuery("NotifyViaSlack").Filter("UserID =", uid)
+	for t := q.Run(ctx); ; {
+		var d NotifyViaSlack
+		_, err := t.Next(&d)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			errorf(logFields{UserID: uid, Handler: "notifySlack"}, "Datastore error: %s", err)
+			return
+		}
+		if err := d.Send(ctx, p); err != nil {
+			warnf(logFields{UserID: uid, Handler: "notifySlack"}, "slack POST failed: %s", err)
+		}
+	}
+}
+
+func postSlackMessage(ctx appengine.Context, url string, text string) error {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{text})
+	if err != nil {
+		return err
+	}
+	resp, err := urlfetch.Client(ctx).Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack POST to %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Register a Slack or Discord incoming webhook. To mitigate abuse, this
+// method is rate-limited the same way registerEmailHandler is.
+func registerSlackHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireCurlOrWget(w, r, "Slack") {
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	parts := strings.SplitN(r.URL.Path, "/", 4)
+	if len(parts) < 4 || len(parts[3]) == 0 {
+		http.Error(w, "Missing webhook URL", http.StatusBadRequest)
+		return
+	}
+	targetURL := parts[3]
+	if !strings.HasPrefix(targetURL, "https://") {
+		http.Error(w, "Webhook URL must be https://", http.StatusBadRequest)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+
+	if channelRegisterLimited(ctx, w, r, "slackreg", targetURL) {
+		return
+	}
+
+	id, err := randHex(8)
+	if err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+	challenge, err := randHex(4)
+	if err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+
+	n := NotifyViaSlack{id, targetURL, false, challenge}
+	k := datastore.NewIncompleteKey(ctx, "NotifyViaSlack", nil)
+	if _, err := datastore.Put(ctx, k, &n); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	// Incoming webhooks can't call us back, so the round trip is: post the
+	// confirmation code into the channel, and a human relays it to the
+	// confirm endpoint to prove they can read it.
+	msg := fmt.Sprintf("Your randomsanity.org confirmation code is %s\nPOST it to /register/slack/confirm/%s/%s to finish registering.", challenge, id, challenge)
+	if err := postSlackMessage(ctx, targetURL, msg); err != nil {
+		warnf(logFields{RemoteIP: r.RemoteAddr, UserID: id, Handler: "registerSlackHandler"}, "slack challenge POST failed: %s", err)
+	}
+
+	fmt.Fprintf(w, "Confirmation code posted to channel, POST it to /register/slack/confirm/%s/<code> to finish registering\n", id)
+}
+
+// confirmSlackHandler completes registration once the confirmation code
+// posted into the channel is relayed back to us.
+func confirmSlackHandler(w http.ResponseWriter, r *http.Request) {
+	confirmChallengeHandler(w, r, "NotifyViaSlack",
+		func() challengeEntity { return &NotifyViaSlack{} },
+		func(id string) string { return "slack channel " + id })
+}
@@ -0,0 +1,142 @@
+package randomsanity
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// NotifyViaTelegram delivers alerts as Telegram bot messages to ChatID.
+// The bot token is shared across all users and configured once via the
+// RANDOMSANITY_TELEGRAM_TOKEN environment variable.
+type NotifyViaTelegram struct {
+	UserID    string
+	ChatID    string
+	Verified  bool
+	Challenge string
+}
+
+func telegramBotToken() string {
+	return os.Getenv("RANDOMSANITY_TELEGRAM_TOKEN")
+}
+
+func (d *NotifyViaTelegram) verified() bool        { return d.Verified }
+func (d *NotifyViaTelegram) challengeCode() string { return d.Challenge }
+func (d *NotifyViaTelegram) confirm()              { d.Verified = true; d.Challenge = "" }
+
+// Send implements Notifier for the Telegram channel.
+func (d NotifyViaTelegram) Send(ctx appengine.Context, p NotifyPayload) error {
+	if !d.Verified {
+		return nil
+	}
+	text := fmt.Sprintf("Random Number Generator Failure Detected\nReason: %s\nTag: %s\nData: 0x%s",
+		p.Reason, p.Tag, p.DataHex)
+	return sendTelegramMessage(ctx, d.ChatID, text)
+}
+
+func notifyTelegram(ctx appengine.Context, uid string, p NotifyPayload) {
+	q := datastore.NewQuery("NotifyViaTelegram").Filter("UserID =", uid)
+	for t := q.Run(ctx); ; {
+		var d NotifyViaTelegram
+		_, err := t.Next(&d)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			errorf(logFields{UserID: uid, Handler: "notifyTelegram"}, "Datastore error: %s", err)
+			return
+		}
+		if err := d.Send(ctx, p); err != nil {
+			warnf(logFields{UserID: uid, Handler: "notifyTelegram"}, "telegram send failed: %s", err)
+		}
+	}
+}
+
+func sendTelegramMessage(ctx appengine.Context, chatID string, text string) error {
+	token := telegramBotToken()
+	if token == "" {
+		return fmt.Errorf("RANDOMSANITY_TELEGRAM_TOKEN not configured")
+	}
+	body, err := json.Marshal(struct {
+		ChatID string `json:"chat_id"`
+		Text   string `json:"text"`
+	}{chatID, text})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", token)
+	resp, err := urlfetch.Client(ctx).Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("telegram sendMessage to %s returned %s", chatID, resp.Status)
+	}
+	return nil
+}
+
+// Register a Telegram chat ID. To mitigate abuse, this method is
+// rate-limited the same way registerEmailHandler is.
+func registerTelegramHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireCurlOrWget(w, r, "Telegram") {
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || len(parts[len(parts)-1]) == 0 {
+		http.Error(w, "Missing chat id", http.StatusBadRequest)
+		return
+	}
+	if len(parts) > 4 {
+		http.Error(w, "URL path too long", http.StatusBadRequest)
+		return
+	}
+	chatID := parts[len(parts)-1]
+
+	ctx := appengine.NewContext(r)
+
+	if channelRegisterLimited(ctx, w, r, "telegramreg", chatID) {
+		return
+	}
+
+	id, err := randHex(8)
+	if err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+	challenge, err := randHex(4)
+	if err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+
+	n := NotifyViaTelegram{id, chatID, false, challenge}
+	k := datastore.NewIncompleteKey(ctx, "NotifyViaTelegram", nil)
+	if _, err := datastore.Put(ctx, k, &n); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	msg := fmt.Sprintf("Your randomsanity.org confirmation code is %s\nPOST it to /register/telegram/confirm/%s/%s to finish registering.", challenge, id, challenge)
+	if err := sendTelegramMessage(ctx, chatID, msg); err != nil {
+		warnf(logFields{RemoteIP: r.RemoteAddr, UserID: id, Handler: "registerTelegramHandler"}, "telegram challenge send failed: %s", err)
+	}
+
+	fmt.Fprintf(w, "Confirmation code sent to chat %s, POST it to /register/telegram/confirm/%s/<code> to finish registering\n", chatID, id)
+}
+
+// confirmTelegramHandler completes registration once the confirmation
+// code sent to the chat is relayed back to us.
+func confirmTelegramHandler(w http.ResponseWriter, r *http.Request) {
+	confirmChallengeHandler(w, r, "NotifyViaTelegram",
+		func() challengeEntity { return &NotifyViaTelegram{} },
+		func(id string) string { return "telegram chat " + id })
+}
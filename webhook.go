@@ -0,0 +1,169 @@
+package randomsanity
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// NotifyViaWebhook is a generic HTTP callback channel: on failure we POST a
+// signed JSON payload to URL. Secret is the HMAC key used both to sign
+// outgoing payloads and to authenticate the confirmation round trip below.
+type NotifyViaWebhook struct {
+	UserID    string
+	URL       string
+	Secret    string
+	Verified  bool
+	Challenge string
+}
+
+func (d *NotifyViaWebhook) verified() bool        { return d.Verified }
+func (d *NotifyViaWebhook) challengeCode() string { return d.Challenge }
+func (d *NotifyViaWebhook) confirm()              { d.Verified = true; d.Challenge = "" }
+
+// Send implements Notifier for the webhook channel.
+func (d NotifyViaWebhook) Send(ctx appengine.Context, p NotifyPayload) error {
+	if !d.Verified {
+		return nil
+	}
+	body := struct {
+		Tag       string `json:"tag"`
+		DataHex   string `json:"data_hex"`
+		Reason    string `json:"reason"`
+		Timestamp int64  `json:"timestamp"`
+	}{p.Tag, p.DataHex, p.Reason, p.Timestamp.Unix()}
+	return postSignedJSON(ctx, d.URL, d.Secret, body)
+}
+
+func notifyWebhooks(ctx appengine.Context, uid string, p NotifyPayload) {
+	q := datastore.NewQuery("NotifyViaWebhook").Filter("UserID =", uid)
+	for t := q.Run(ctx); ; {
+		var d NotifyViaWebhook
+		_, err := t.Next(&d)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			errorf(logFields{UserID: uid, Handler: "notifyWebhooks"}, "Datastore error: %s", err)
+			return
+		}
+		if err := d.Send(ctx, p); err != nil {
+			warnf(logFields{UserID: uid, Handler: "notifyWebhooks"}, "webhook POST failed: %s", err)
+		}
+	}
+}
+
+// webhookSignature returns the hex-encoded HMAC-SHA256 of body keyed by
+// secret. Receivers can recompute it over the body and compare it with the
+// X-Randomsanity-Signature header to verify a payload really came from
+// randomsanity.org.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// postSignedJSON marshals v, signs it with secret and POSTs it to url.
+func postSignedJSON(ctx appengine.Context, url string, secret string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Randomsanity-Signature", webhookSignature(secret, body))
+
+	resp, err := urlfetch.Client(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook POST to %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Register a generic HTTP webhook. To mitigate abuse, this method is
+// rate-limited the same way registerEmailHandler is.
+func registerWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireCurlOrWget(w, r, "Webhook") {
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	parts := strings.SplitN(r.URL.Path, "/", 4)
+	if len(parts) < 4 || len(parts[3]) == 0 {
+		http.Error(w, "Missing webhook URL", http.StatusBadRequest)
+		return
+	}
+	targetURL := parts[3]
+	if !strings.HasPrefix(targetURL, "https://") {
+		http.Error(w, "Webhook URL must be https://", http.StatusBadRequest)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+
+	if channelRegisterLimited(ctx, w, r, "webhookreg", targetURL) {
+		return
+	}
+
+	id, err := randHex(8)
+	if err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+	secret, err := randHex(16)
+	if err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+	challenge, err := randHex(8)
+	if err != nil {
+		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		return
+	}
+
+	n := NotifyViaWebhook{id, targetURL, secret, false, challenge}
+	k := datastore.NewIncompleteKey(ctx, "NotifyViaWebhook", nil)
+	if _, err := datastore.Put(ctx, k, &n); err != nil {
+		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		return
+	}
+
+	// Prove the caller actually controls targetURL before we ever send it
+	// real data: POST a challenge nonce that must be echoed back to the
+	// confirm endpoint.
+	challengeBody := struct {
+		Challenge string `json:"challenge"`
+		ConfirmTo string `json:"confirm_to"`
+	}{challenge, "/register/webhook/confirm/" + id + "/" + challenge}
+	if err := postSignedJSON(ctx, targetURL, secret, challengeBody); err != nil {
+		warnf(logFields{RemoteIP: r.RemoteAddr, UserID: id, Handler: "registerWebhookHandler"}, "webhook challenge POST failed: %s", err)
+	}
+
+	// secret is only ever disclosed here, same as the email id is only ever
+	// emailed once: the receiving endpoint needs it to verify
+	// X-Randomsanity-Signature on every payload we send it afterwards.
+	fmt.Fprintf(w, "Challenge sent to %s, POST it back to /register/webhook/confirm/%s/<challenge> to finish registering\nSigning secret (save this, it will not be shown again): %s\n", targetURL, id, secret)
+}
+
+// confirmWebhookHandler completes registration once the receiving endpoint
+// echoes the challenge nonce back to us, proving it controls the URL.
+func confirmWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	confirmChallengeHandler(w, r, "NotifyViaWebhook",
+		func() challengeEntity { return &NotifyViaWebhook{} },
+		func(id string) string { return "webhook " + id })
+}